@@ -7,12 +7,15 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/containers/storage/pkg/reexec"
 	"github.com/sirupsen/logrus"
@@ -20,13 +23,17 @@ import (
 )
 
 const (
-	openChrootedCommand = Package + "-open"
+	openChrootedCommand       = Package + "-open"
+	chrootUserResolverCommand = Package + "-chrootuser-resolver"
 )
 
 func init() {
 	reexec.Register(openChrootedCommand, openChrootedFileMain)
+	reexec.Register(chrootUserResolverCommand, chrootUserResolverMain)
 }
 
+var openChrootedListFlag = flag.Bool("list", false, "list directory entries instead of dumping file contents")
+
 func openChrootedFileMain() {
 	status := 0
 	flag.Parse()
@@ -42,6 +49,22 @@ func openChrootedFileMain() {
 		fmt.Fprintf(os.Stderr, "chroot(): %v", err)
 		os.Exit(1)
 	}
+	if *openChrootedListFlag {
+		// Remaining arguments are directories; list their entries, one
+		// name per line, instead of dumping file contents.
+		for _, dirname := range flag.Args()[1:] {
+			entries, err := ioutil.ReadDir(dirname)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "readdir(%q): %v", dirname, err)
+				status = 1
+				continue
+			}
+			for _, entry := range entries {
+				fmt.Fprintln(os.Stdout, entry.Name())
+			}
+		}
+		os.Exit(status)
+	}
 	// Anything else is a file we want to dump out.
 	for _, filename := range flag.Args()[1:] {
 		f, err := os.Open(filename)
@@ -76,6 +99,23 @@ func openChrootedFile(rootdir, filename string) (*exec.Cmd, io.ReadCloser, error
 	return cmd, stdout, nil
 }
 
+// openChrootedDir lists the entries of dirname relative to rootdir's
+// chroot, the same way openChrootedFile reads a file: the listing
+// happens inside the reexec child after chrooting, so a symlink at
+// dirname can't be used to enumerate a directory outside rootdir.
+func openChrootedDir(rootdir, dirname string) (*exec.Cmd, io.ReadCloser, error) {
+	cmd := reexec.Command(openChrootedCommand, "-list", rootdir, dirname)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cmd, stdout, nil
+}
+
 var (
 	lookupUser, lookupGroup sync.Mutex
 )
@@ -84,10 +124,12 @@ type lookupPasswdEntry struct {
 	name string
 	uid  uint64
 	gid  uint64
+	home string
 }
 type lookupGroupEntry struct {
-	name string
-	gid  uint64
+	name  string
+	gid   uint64
+	users []string
 }
 
 func readWholeLine(rc *bufio.Reader) ([]byte, error) {
@@ -134,6 +176,7 @@ func parseNextPasswd(rc *bufio.Reader) *lookupPasswdEntry {
 		name: fields[0],
 		uid:  uid,
 		gid:  gid,
+		home: fields[5],
 	}
 }
 
@@ -150,13 +193,21 @@ func parseNextGroup(rc *bufio.Reader) *lookupGroupEntry {
 	if err != nil {
 		return nil
 	}
+	var users []string
+	if fields[3] != "" {
+		users = strings.Split(fields[3], ",")
+	}
 	return &lookupGroupEntry{
-		name: fields[0],
-		gid:  gid,
+		name:  fields[0],
+		gid:   gid,
+		users: users,
 	}
 }
 
-func lookupUserInContainer(rootdir, username string) (uid uint64, gid uint64, err error) {
+// lookupUserInContainerOnce is the one-shot fallback for lookupUserInContainer:
+// it forks a fresh openChrootedFile child to read /etc/passwd for this one
+// lookup, rather than going through a cached resolver.
+func lookupUserInContainerOnce(rootdir, username string) (uid uint64, gid uint64, err error) {
 	cmd, f, err := openChrootedFile(rootdir, "/etc/passwd")
 	if err != nil {
 		return 0, 0, err
@@ -182,7 +233,9 @@ func lookupUserInContainer(rootdir, username string) (uid uint64, gid uint64, er
 	return 0, 0, user.UnknownUserError(fmt.Sprintf("error looking up user %q", username))
 }
 
-func lookupGroupForUIDInContainer(rootdir string, userid uint64) (username string, gid uint64, err error) {
+// lookupGroupForUIDInContainerOnce is the one-shot fallback for
+// lookupGroupForUIDInContainer.
+func lookupGroupForUIDInContainerOnce(rootdir string, userid uint64) (username string, gid uint64, err error) {
 	cmd, f, err := openChrootedFile(rootdir, "/etc/passwd")
 	if err != nil {
 		return "", 0, err
@@ -208,7 +261,9 @@ func lookupGroupForUIDInContainer(rootdir string, userid uint64) (username strin
 	return "", 0, user.UnknownUserError(fmt.Sprintf("error looking up user with UID %d", userid))
 }
 
-func lookupGroupInContainer(rootdir, groupname string) (gid uint64, err error) {
+// lookupGroupInContainerOnce is the one-shot fallback for
+// lookupGroupInContainer.
+func lookupGroupInContainerOnce(rootdir, groupname string) (gid uint64, err error) {
 	cmd, f, err := openChrootedFile(rootdir, "/etc/group")
 	if err != nil {
 		return 0, err
@@ -233,3 +288,1030 @@ func lookupGroupInContainer(rootdir, groupname string) (gid uint64, err error) {
 
 	return 0, user.UnknownGroupError(fmt.Sprintf("error looking up group %q", groupname))
 }
+
+// lookupAdditionalGroupsForUIDInContainerOnce is the one-shot fallback for
+// lookupAdditionalGroupsForUIDInContainer.  It does not include the user's
+// primary GID from /etc/passwd.
+func lookupAdditionalGroupsForUIDInContainerOnce(rootdir string, userid uint64) (gids []uint32, err error) {
+	username, _, err := lookupGroupForUIDInContainerOnce(rootdir, userid)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd, f, err := openChrootedFile(rootdir, "/etc/group")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cmd.Wait()
+	}()
+	rc := bufio.NewReader(f)
+	defer f.Close()
+
+	lookupGroup.Lock()
+	defer lookupGroup.Unlock()
+
+	grp := parseNextGroup(rc)
+	for grp != nil {
+		for _, member := range grp.users {
+			if member == username {
+				gids = append(gids, uint32(grp.gid))
+				break
+			}
+		}
+		grp = parseNextGroup(rc)
+	}
+
+	return gids, nil
+}
+
+// LookupUIDInContainer returns the username and primary GID recorded for
+// the given UID in rootdir, consulting rootdir's configured NSSSources in
+// order (see nssSourcesForRootdir).  It's the exported form of
+// lookupGroupForUIDInContainer, for callers outside this package that
+// need to check whether a UID has an entry before deciding whether to
+// synthesize one.
+func LookupUIDInContainer(rootdir string, uid uint64) (username string, gid uint64, err error) {
+	return lookupGroupForUIDInContainer(rootdir, uid)
+}
+
+const (
+	syntheticPasswdFormat = "%d:x:%d:%d:container user:/:/bin/sh\n"
+	syntheticGroupFormat  = "%d:x:%d:\n"
+)
+
+// syntheticOverlayMode is world-readable: a synthesized /etc/passwd or
+// /etc/group is bind-mounted into the container for every process there
+// to consult via getpwuid(3)/getgrgid(3), not just the UID it was
+// generated for, so ioutil.TempFile's default 0600 (owner-only) would
+// leave it unreadable by the very processes it's meant to serve.
+const syntheticOverlayMode = 0o644
+
+// GenerateSyntheticUserOverlay builds a minimal /etc/passwd and /etc/group
+// entry for a UID/GID pair when the UID has no entry in rootdir (as
+// resolved by lookupGroupForUIDInContainer through rootdir's configured
+// NSSSources; the GID is not looked up), and writes them out to two
+// temporary files that the
+// caller can bind-mount over /etc/passwd and /etc/group inside the
+// container.  It's meant for the buildah run/build path, so that
+// rootless builds running under an arbitrary host UID -- one that can
+// never appear in the base image -- still satisfy tools that call
+// getpwuid(3).  If the UID already has an entry, both paths come back
+// empty and err is nil, telling the caller no overlay is needed.
+func GenerateSyntheticUserOverlay(rootdir string, uid, gid uint64) (passwdFile, groupFile string, err error) {
+	if _, _, err = lookupGroupForUIDInContainer(rootdir, uid); err == nil {
+		return "", "", nil
+	}
+	if _, ok := err.(user.UnknownUserError); !ok {
+		return "", "", err
+	}
+
+	passwd, err := ioutil.TempFile("", "passwd")
+	if err != nil {
+		return "", "", err
+	}
+	defer passwd.Close()
+	if err = passwd.Chmod(syntheticOverlayMode); err != nil {
+		return "", "", err
+	}
+	if _, err = fmt.Fprintf(passwd, syntheticPasswdFormat, uid, uid, gid); err != nil {
+		return "", "", err
+	}
+
+	group, err := ioutil.TempFile("", "group")
+	if err != nil {
+		return "", "", err
+	}
+	defer group.Close()
+	if err = group.Chmod(syntheticOverlayMode); err != nil {
+		return "", "", err
+	}
+	if _, err = fmt.Fprintf(group, syntheticGroupFormat, gid, gid); err != nil {
+		return "", "", err
+	}
+
+	return passwd.Name(), group.Name(), nil
+}
+
+// chrootUserResolver is a handle on a long-lived chrootUserResolverCommand
+// child that has already read rootdir's /etc/passwd and /etc/group once
+// and serves subsequent lookups for that rootdir out of memory, over a
+// Unix socketpair, instead of forking and re-reading the files for every
+// lookup.  passwdModTime and groupModTime record the mtimes of those
+// files at the moment the child read them, so getChrootUserResolver can
+// tell when they've since changed underneath it.
+type chrootUserResolver struct {
+	cmd  *exec.Cmd
+	conn *os.File
+	rc   *bufio.Reader
+	mu   sync.Mutex
+
+	passwdModTime time.Time
+	groupModTime  time.Time
+}
+
+var (
+	chrootUserResolversMutex sync.Mutex
+	chrootUserResolvers      = map[string]*chrootUserResolver{}
+)
+
+// chrootedFileModTime returns the modification time of path under
+// rootdir, or the zero Time if it can't be stat()ed.  It's used only to
+// decide whether a cached resolver's snapshot is stale, not to read file
+// contents, so it doesn't need to go through the chroot.
+func chrootedFileModTime(rootdir, path string) time.Time {
+	info, err := os.Stat(filepath.Join(rootdir, path))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// getChrootUserResolver returns the cached resolver for rootdir, spawning
+// one if this is the first lookup against that rootdir, or if
+// /etc/passwd or /etc/group have been modified since the cached resolver
+// read them -- e.g. a RUN useradd between two USER/--chown lookups in the
+// same build.  Callers should fall back to the one-shot *Once functions
+// if this returns an error, which it will if reexec isn't available in
+// this binary.
+func getChrootUserResolver(rootdir string) (*chrootUserResolver, error) {
+	chrootUserResolversMutex.Lock()
+	defer chrootUserResolversMutex.Unlock()
+
+	passwdModTime := chrootedFileModTime(rootdir, "etc/passwd")
+	groupModTime := chrootedFileModTime(rootdir, "etc/group")
+
+	if resolver, ok := chrootUserResolvers[rootdir]; ok {
+		if resolver.passwdModTime.Equal(passwdModTime) && resolver.groupModTime.Equal(groupModTime) {
+			return resolver, nil
+		}
+		delete(chrootUserResolvers, rootdir)
+		_ = resolver.Close()
+	}
+
+	resolver, err := newChrootUserResolver(rootdir, passwdModTime, groupModTime)
+	if err != nil {
+		return nil, err
+	}
+	chrootUserResolvers[rootdir] = resolver
+	return resolver, nil
+}
+
+// CloseChrootUserResolver shuts down and forgets the cached resolver for
+// rootdir, if one was ever started.  The buildah Builder should call this
+// when it's done with a container's rootdir, so the resolver's reexec
+// child doesn't outlive it.
+func CloseChrootUserResolver(rootdir string) error {
+	chrootUserResolversMutex.Lock()
+	defer chrootUserResolversMutex.Unlock()
+
+	resolver, ok := chrootUserResolvers[rootdir]
+	if !ok {
+		return nil
+	}
+	delete(chrootUserResolvers, rootdir)
+	return resolver.Close()
+}
+
+func newChrootUserResolver(rootdir string, passwdModTime, groupModTime time.Time) (*chrootUserResolver, error) {
+	// SOCK_CLOEXEC keeps each end from leaking across the reexec below:
+	// without it, the child inherits a second, un-closeable reference to
+	// its own peer socket via plain fd inheritance (not the ExtraFiles
+	// slot), so closing the parent's end to signal shutdown never
+	// produces EOF in the child and it runs forever.
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	parent := os.NewFile(uintptr(fds[0]), "chrootuser-resolver-parent")
+	child := os.NewFile(uintptr(fds[1]), "chrootuser-resolver-child")
+	defer child.Close()
+
+	cmd := reexec.Command(chrootUserResolverCommand, rootdir)
+	cmd.ExtraFiles = []*os.File{child}
+	if err = cmd.Start(); err != nil {
+		parent.Close()
+		return nil, err
+	}
+
+	return &chrootUserResolver{
+		cmd:           cmd,
+		conn:          parent,
+		rc:            bufio.NewReader(parent),
+		passwdModTime: passwdModTime,
+		groupModTime:  groupModTime,
+	}, nil
+}
+
+func (r *chrootUserResolver) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	connErr := r.conn.Close()
+	waitErr := r.cmd.Wait()
+	if connErr != nil {
+		return connErr
+	}
+	return waitErr
+}
+
+// request sends a single "COMMAND arg" line and returns the response
+// line with its "OK "/"ERR " prefix stripped, or an error if the
+// response was an ERR or the socket failed.
+func (r *chrootUserResolver) request(command, arg string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := fmt.Fprintf(r.conn, "%s %s\n", command, arg); err != nil {
+		return "", err
+	}
+	line, err := readWholeLine(r.rc)
+	if err != nil {
+		return "", err
+	}
+	response := string(line)
+	if strings.HasPrefix(response, "OK ") {
+		return strings.TrimPrefix(response, "OK "), nil
+	}
+	return "", fmt.Errorf("%s", strings.TrimPrefix(response, "ERR "))
+}
+
+func (r *chrootUserResolver) lookupUser(username string) (uid, gid uint64, err error) {
+	response, err := r.request("LOOKUP_USER", username)
+	if err != nil {
+		return 0, 0, user.UnknownUserError(fmt.Sprintf("error looking up user %q", username))
+	}
+	if _, err = fmt.Sscanf(response, "%d %d", &uid, &gid); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
+
+func (r *chrootUserResolver) lookupUID(uid uint64) (username string, gid uint64, err error) {
+	response, err := r.request("LOOKUP_UID", strconv.FormatUint(uid, 10))
+	if err != nil {
+		return "", 0, user.UnknownUserError(fmt.Sprintf("error looking up user with UID %d", uid))
+	}
+	fields := strings.SplitN(strings.TrimSpace(response), " ", 2)
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("malformed LOOKUP_UID response %q", response)
+	}
+	if gid, err = strconv.ParseUint(fields[1], 10, 32); err != nil {
+		return "", 0, err
+	}
+	return fields[0], gid, nil
+}
+
+func (r *chrootUserResolver) lookupGroup(groupname string) (gid uint64, err error) {
+	response, err := r.request("LOOKUP_GROUP", groupname)
+	if err != nil {
+		return 0, user.UnknownGroupError(fmt.Sprintf("error looking up group %q", groupname))
+	}
+	if gid, err = strconv.ParseUint(strings.TrimSpace(response), 10, 32); err != nil {
+		return 0, err
+	}
+	return gid, nil
+}
+
+func (r *chrootUserResolver) lookupGIDMembers(uid uint64) (gids []uint32, err error) {
+	response, err := r.request("LOOKUP_GID_MEMBERS", strconv.FormatUint(uid, 10))
+	if err != nil {
+		return nil, err
+	}
+	response = strings.TrimSpace(response)
+	if response == "" {
+		return nil, nil
+	}
+	for _, field := range strings.Split(response, ",") {
+		gid, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		gids = append(gids, uint32(gid))
+	}
+	return gids, nil
+}
+
+func (r *chrootUserResolver) lookupHome(username string) (home string, err error) {
+	response, err := r.request("LOOKUP_HOME", username)
+	if err != nil {
+		return "", user.UnknownUserError(fmt.Sprintf("error looking up user %q", username))
+	}
+	return response, nil
+}
+
+// chrootUserResolverMain is the entry point for the chrootUserResolverCommand
+// reexec child.  It chroots into the rootdir given as its first argument,
+// reads /etc/passwd and /etc/group there exactly once into memory, and then
+// answers LOOKUP_USER/LOOKUP_UID/LOOKUP_GROUP/LOOKUP_GID_MEMBERS/LOOKUP_HOME
+// requests read from fd 3 until that socket is closed.
+func chrootUserResolverMain() {
+	flag.Parse()
+	if len(flag.Args()) < 1 {
+		os.Exit(1)
+	}
+	rootdir := flag.Arg(0)
+	if err := unix.Chdir(rootdir); err != nil {
+		fmt.Fprintf(os.Stderr, "chdir(): %v", err)
+		os.Exit(1)
+	}
+	if err := unix.Chroot(rootdir); err != nil {
+		fmt.Fprintf(os.Stderr, "chroot(): %v", err)
+		os.Exit(1)
+	}
+
+	passwdByName := make(map[string]*lookupPasswdEntry)
+	passwdByUID := make(map[uint64]*lookupPasswdEntry)
+	if f, err := os.Open("/etc/passwd"); err == nil {
+		prc := bufio.NewReader(f)
+		for pwd := parseNextPasswd(prc); pwd != nil; pwd = parseNextPasswd(prc) {
+			passwdByName[pwd.name] = pwd
+			passwdByUID[pwd.uid] = pwd
+		}
+		f.Close()
+	}
+
+	groupByName := make(map[string]*lookupGroupEntry)
+	membersByUsername := make(map[string][]uint32)
+	if f, err := os.Open("/etc/group"); err == nil {
+		grc := bufio.NewReader(f)
+		for grp := parseNextGroup(grc); grp != nil; grp = parseNextGroup(grc) {
+			groupByName[grp.name] = grp
+			for _, member := range grp.users {
+				membersByUsername[member] = append(membersByUsername[member], uint32(grp.gid))
+			}
+		}
+		f.Close()
+	}
+
+	conn := os.NewFile(3, "chrootuser-resolver-socket")
+	rc := bufio.NewReader(conn)
+	for {
+		line, err := readWholeLine(rc)
+		if err != nil {
+			return
+		}
+		fields := strings.SplitN(strings.TrimSpace(string(line)), " ", 2)
+		if len(fields) != 2 {
+			fmt.Fprintf(conn, "ERR malformed request\n")
+			continue
+		}
+		switch fields[0] {
+		case "LOOKUP_USER":
+			if pwd, ok := passwdByName[fields[1]]; ok {
+				fmt.Fprintf(conn, "OK %d %d\n", pwd.uid, pwd.gid)
+			} else {
+				fmt.Fprintf(conn, "ERR unknown user %s\n", fields[1])
+			}
+		case "LOOKUP_UID":
+			uid, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				fmt.Fprintf(conn, "ERR %v\n", err)
+				continue
+			}
+			if pwd, ok := passwdByUID[uid]; ok {
+				fmt.Fprintf(conn, "OK %s %d\n", pwd.name, pwd.gid)
+			} else {
+				fmt.Fprintf(conn, "ERR unknown uid %d\n", uid)
+			}
+		case "LOOKUP_GROUP":
+			if grp, ok := groupByName[fields[1]]; ok {
+				fmt.Fprintf(conn, "OK %d\n", grp.gid)
+			} else {
+				fmt.Fprintf(conn, "ERR unknown group %s\n", fields[1])
+			}
+		case "LOOKUP_GID_MEMBERS":
+			uid, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				fmt.Fprintf(conn, "ERR %v\n", err)
+				continue
+			}
+			pwd, ok := passwdByUID[uid]
+			if !ok {
+				fmt.Fprintf(conn, "ERR unknown uid %d\n", uid)
+				continue
+			}
+			gids := membersByUsername[pwd.name]
+			strs := make([]string, len(gids))
+			for i, gid := range gids {
+				strs[i] = strconv.FormatUint(uint64(gid), 10)
+			}
+			fmt.Fprintf(conn, "OK %s\n", strings.Join(strs, ","))
+		case "LOOKUP_HOME":
+			if pwd, ok := passwdByName[fields[1]]; ok {
+				fmt.Fprintf(conn, "OK %s\n", pwd.home)
+			} else {
+				fmt.Fprintf(conn, "ERR unknown user %s\n", fields[1])
+			}
+		default:
+			fmt.Fprintf(conn, "ERR unknown command %s\n", fields[0])
+		}
+	}
+}
+
+// lookupUserFilesInContainer resolves username against rootdir's
+// /etc/passwd, using a cached resolver process when one is available and
+// falling back to a one-shot chrooted read otherwise.  It backs the
+// "files" NSSSource.
+func lookupUserFilesInContainer(rootdir, username string) (uid uint64, gid uint64, err error) {
+	if resolver, rerr := getChrootUserResolver(rootdir); rerr == nil {
+		return resolver.lookupUser(username)
+	}
+	return lookupUserInContainerOnce(rootdir, username)
+}
+
+// lookupUIDFilesInContainer resolves userid against rootdir's
+// /etc/passwd, using a cached resolver process when one is available and
+// falling back to a one-shot chrooted read otherwise.  It backs the
+// "files" NSSSource.
+func lookupUIDFilesInContainer(rootdir string, userid uint64) (username string, gid uint64, err error) {
+	if resolver, rerr := getChrootUserResolver(rootdir); rerr == nil {
+		return resolver.lookupUID(userid)
+	}
+	return lookupGroupForUIDInContainerOnce(rootdir, userid)
+}
+
+// lookupGroupFilesInContainer resolves groupname against rootdir's
+// /etc/group, using a cached resolver process when one is available and
+// falling back to a one-shot chrooted read otherwise.  It backs the
+// "files" NSSSource.
+func lookupGroupFilesInContainer(rootdir, groupname string) (gid uint64, err error) {
+	if resolver, rerr := getChrootUserResolver(rootdir); rerr == nil {
+		return resolver.lookupGroup(groupname)
+	}
+	return lookupGroupInContainerOnce(rootdir, groupname)
+}
+
+// lookupHomeFilesInContainer resolves username's home directory field
+// against rootdir's /etc/passwd, using a cached resolver process when
+// one is available and falling back to a one-shot chrooted read
+// otherwise.  It backs the "files" NSSSource.
+func lookupHomeFilesInContainer(rootdir, username string) (home string, err error) {
+	if resolver, rerr := getChrootUserResolver(rootdir); rerr == nil {
+		return resolver.lookupHome(username)
+	}
+	return lookupHomeInFile(rootdir, "/etc/passwd", username)
+}
+
+// lookupAdditionalGroupsForUIDInContainer returns the GIDs of the groups
+// that the user with the given UID is a member of, as recorded in the
+// fourth field of /etc/group, the same set that initgroups(3) would
+// return.  It does not include the user's primary GID from /etc/passwd.
+// It uses a cached resolver process when one is available and falls back
+// to a one-shot chrooted read otherwise.
+func lookupAdditionalGroupsForUIDInContainer(rootdir string, userid uint64) (gids []uint32, err error) {
+	if resolver, rerr := getChrootUserResolver(rootdir); rerr == nil {
+		return resolver.lookupGIDMembers(userid)
+	}
+	return lookupAdditionalGroupsForUIDInContainerOnce(rootdir, userid)
+}
+
+// NSSSource is a pluggable backend for resolving usernames, UIDs, and
+// group names against a container's rootfs, mirroring the way
+// nsswitch.conf lets glibc consult more than one name service.
+// lookupUserInContainer and friends walk a rootdir's configured
+// NSSSources in order and return the first hit.
+type NSSSource interface {
+	// LookupUser resolves a username to its primary UID/GID.
+	LookupUser(rootdir, username string) (uid, gid uint64, err error)
+	// LookupUID resolves a UID to its username and primary GID.
+	LookupUID(rootdir string, uid uint64) (username string, gid uint64, err error)
+	// LookupGroup resolves a group name to its GID.
+	LookupGroup(rootdir, groupname string) (gid uint64, err error)
+	// LookupHome resolves a username to its home directory field.
+	LookupHome(rootdir, username string) (home string, err error)
+}
+
+// filesNSSSource is the "files" nsswitch module: /etc/passwd and
+// /etc/group, read through the cached chroot resolver.
+type filesNSSSource struct{}
+
+func (filesNSSSource) LookupUser(rootdir, username string) (uid, gid uint64, err error) {
+	return lookupUserFilesInContainer(rootdir, username)
+}
+
+func (filesNSSSource) LookupUID(rootdir string, uid uint64) (username string, gid uint64, err error) {
+	return lookupUIDFilesInContainer(rootdir, uid)
+}
+
+func (filesNSSSource) LookupGroup(rootdir, groupname string) (gid uint64, err error) {
+	return lookupGroupFilesInContainer(rootdir, groupname)
+}
+
+func (filesNSSSource) LookupHome(rootdir, username string) (home string, err error) {
+	return lookupHomeFilesInContainer(rootdir, username)
+}
+
+// altfilesNSSSource is the "altfiles" nsswitch module used by
+// ostree/CoreOS-style base images: it resolves against /usr/lib/passwd
+// and /usr/lib/group, which ship the image's accounts, leaving
+// /etc/passwd and /etc/group free for machine-local additions.
+type altfilesNSSSource struct{}
+
+func (altfilesNSSSource) LookupUser(rootdir, username string) (uid, gid uint64, err error) {
+	return lookupUserInFile(rootdir, "/usr/lib/passwd", username)
+}
+
+func (altfilesNSSSource) LookupUID(rootdir string, uid uint64) (username string, gid uint64, err error) {
+	return lookupUIDInFile(rootdir, "/usr/lib/passwd", uid)
+}
+
+func (altfilesNSSSource) LookupGroup(rootdir, groupname string) (gid uint64, err error) {
+	return lookupGroupInFile(rootdir, "/usr/lib/group", groupname)
+}
+
+func (altfilesNSSSource) LookupHome(rootdir, username string) (home string, err error) {
+	return lookupHomeInFile(rootdir, "/usr/lib/passwd", username)
+}
+
+func lookupUserInFile(rootdir, path, username string) (uid uint64, gid uint64, err error) {
+	cmd, f, err := openChrootedFile(rootdir, path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		_ = cmd.Wait()
+	}()
+	rc := bufio.NewReader(f)
+	defer f.Close()
+
+	lookupUser.Lock()
+	defer lookupUser.Unlock()
+
+	pwd := parseNextPasswd(rc)
+	for pwd != nil {
+		if pwd.name != username {
+			pwd = parseNextPasswd(rc)
+			continue
+		}
+		return pwd.uid, pwd.gid, nil
+	}
+
+	return 0, 0, user.UnknownUserError(fmt.Sprintf("error looking up user %q in %s", username, path))
+}
+
+// lookupHomeInFile resolves username's home directory field against
+// rootdir's copy of path, the passwd-format file given.
+func lookupHomeInFile(rootdir, path, username string) (home string, err error) {
+	cmd, f, err := openChrootedFile(rootdir, path)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = cmd.Wait()
+	}()
+	rc := bufio.NewReader(f)
+	defer f.Close()
+
+	lookupUser.Lock()
+	defer lookupUser.Unlock()
+
+	pwd := parseNextPasswd(rc)
+	for pwd != nil {
+		if pwd.name != username {
+			pwd = parseNextPasswd(rc)
+			continue
+		}
+		return pwd.home, nil
+	}
+
+	return "", user.UnknownUserError(fmt.Sprintf("error looking up user %q in %s", username, path))
+}
+
+func lookupUIDInFile(rootdir, path string, userid uint64) (username string, gid uint64, err error) {
+	cmd, f, err := openChrootedFile(rootdir, path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		_ = cmd.Wait()
+	}()
+	rc := bufio.NewReader(f)
+	defer f.Close()
+
+	lookupUser.Lock()
+	defer lookupUser.Unlock()
+
+	pwd := parseNextPasswd(rc)
+	for pwd != nil {
+		if pwd.uid != userid {
+			pwd = parseNextPasswd(rc)
+			continue
+		}
+		return pwd.name, pwd.gid, nil
+	}
+
+	return "", 0, user.UnknownUserError(fmt.Sprintf("error looking up user with UID %d in %s", userid, path))
+}
+
+func lookupGroupInFile(rootdir, path, groupname string) (gid uint64, err error) {
+	cmd, f, err := openChrootedFile(rootdir, path)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = cmd.Wait()
+	}()
+	rc := bufio.NewReader(f)
+	defer f.Close()
+
+	lookupGroup.Lock()
+	defer lookupGroup.Unlock()
+
+	grp := parseNextGroup(rc)
+	for grp != nil {
+		if grp.name != groupname {
+			grp = parseNextGroup(rc)
+			continue
+		}
+		return grp.gid, nil
+	}
+
+	return 0, user.UnknownGroupError(fmt.Sprintf("error looking up group %q in %s", groupname, path))
+}
+
+// sysusersEntries is the parsed contents of a rootdir's sysusers.d
+// snippets: accounts that the base image declares but that systemd's
+// sysusers.d generator hasn't yet materialized into /etc/passwd and
+// /etc/group, common on minimal Fedora/CoreOS-derived images.
+type sysusersEntries struct {
+	usersByName  map[string]*lookupPasswdEntry
+	usersByUID   map[uint64]*lookupPasswdEntry
+	groupsByName map[string]uint64
+}
+
+// parseSysusersConfLine parses one line of a sysusers.d(5) config file,
+// returning its record type ('u', 'g', or 'm'), the account/group name,
+// and the raw ID field (empty for 'm' lines).  GECOS, home, and shell
+// fields are ignored: we only need enough to resolve USER/--chown.
+func parseSysusersConfLine(line string) (kind byte, name string, idField string, ok bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return 0, "", "", false
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields[0]) != 1 {
+		return 0, "", "", false
+	}
+	idField = ""
+	if fields[0] != "m" && len(fields) >= 3 {
+		idField = fields[2]
+	}
+	return fields[0][0], fields[1], idField, true
+}
+
+// listChrootedConfDir lists the *.conf files directly under dir inside
+// rootdir's chroot, the same way the shell glob "dir/*.conf" would,
+// without ever resolving a path outside the chroot: the listing and the
+// reads it enables both happen inside the openChrootedFile reexec child,
+// so a symlink planted under dir can't point the caller at a host file.
+func listChrootedConfDir(rootdir, dir string) ([]string, error) {
+	cmd, f, err := openChrootedDir(rootdir, "/"+dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = cmd.Wait()
+	}()
+	names, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	var confFiles []string
+	for _, name := range strings.Split(string(names), "\n") {
+		if name != "" && strings.HasSuffix(name, ".conf") {
+			confFiles = append(confFiles, filepath.Join("/"+dir, name))
+		}
+	}
+	return confFiles, nil
+}
+
+// readSysusersEntries reads every *.conf snippet under
+// /usr/lib/sysusers.d and /etc/sysusers.d inside rootdir and synthesizes
+// the passwd/group entries they declare.  Both the directory listing and
+// the file reads go through openChrootedFile, the same chroot+reexec
+// every other lookup in this file uses, so a symlink under either
+// sysusers.d directory can't be used to read a file outside rootdir.  ID
+// fields of "-" (auto-assign) or a referenced existing username aren't
+// resolvable without running systemd-sysusers itself, so those entries
+// are skipped.  'm' lines, which only add a user to an existing group's
+// membership, don't introduce a passwd/group entry and are skipped too.
+func readSysusersEntries(rootdir string) (*sysusersEntries, error) {
+	entries := &sysusersEntries{
+		usersByName:  make(map[string]*lookupPasswdEntry),
+		usersByUID:   make(map[uint64]*lookupPasswdEntry),
+		groupsByName: make(map[string]uint64),
+	}
+
+	var confFiles []string
+	for _, dir := range []string{"usr/lib/sysusers.d", "etc/sysusers.d"} {
+		matches, err := listChrootedConfDir(rootdir, dir)
+		if err != nil {
+			continue
+		}
+		confFiles = append(confFiles, matches...)
+	}
+
+	for _, confFile := range confFiles {
+		cmd, f, err := openChrootedFile(rootdir, confFile)
+		if err != nil {
+			continue
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		_ = cmd.Wait()
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			kind, name, idField, ok := parseSysusersConfLine(line)
+			if !ok {
+				continue
+			}
+			switch kind {
+			case 'g':
+				gid, err := strconv.ParseUint(idField, 10, 32)
+				if err != nil {
+					continue
+				}
+				entries.groupsByName[name] = gid
+			case 'u':
+				uidField, gidField := idField, idField
+				if parts := strings.SplitN(idField, ":", 2); len(parts) == 2 {
+					uidField, gidField = parts[0], parts[1]
+				}
+				uid, err := strconv.ParseUint(uidField, 10, 32)
+				if err != nil {
+					continue
+				}
+				gid := uid
+				if gidField != uidField {
+					if parsedGid, gerr := strconv.ParseUint(gidField, 10, 32); gerr == nil {
+						gid = parsedGid
+					} else if namedGid, ok := entries.groupsByName[gidField]; ok {
+						// The ID field named a group ("u syslog 104:adm")
+						// instead of a numeric GID; resolve it against the
+						// groups we've already parsed out of sysusers.d.
+						gid = namedGid
+					} else if resolvedGid, gerr := lookupGroupFilesOrAltfiles(rootdir, gidField); gerr == nil {
+						// Not declared in sysusers.d either; fall back to
+						// the container's own /etc/group and /usr/lib/group
+						// (not the full
+						// NSSSource chain, which would recurse back into
+						// readSysusersEntries).
+						gid = resolvedGid
+					}
+				} else if existingGid, ok := entries.groupsByName[name]; ok {
+					gid = existingGid
+				}
+				entry := &lookupPasswdEntry{name: name, uid: uid, gid: gid}
+				entries.usersByName[name] = entry
+				entries.usersByUID[uid] = entry
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// sysusersNSSSource synthesizes passwd/group entries from a rootdir's
+// sysusers.d(5) snippets, for accounts a base image declares but hasn't
+// materialized into /etc/passwd or /etc/group.
+type sysusersNSSSource struct{}
+
+func (sysusersNSSSource) LookupUser(rootdir, username string) (uid, gid uint64, err error) {
+	entries, err := readSysusersEntries(rootdir)
+	if err != nil {
+		return 0, 0, err
+	}
+	if entry, ok := entries.usersByName[username]; ok {
+		return entry.uid, entry.gid, nil
+	}
+	return 0, 0, user.UnknownUserError(fmt.Sprintf("error looking up user %q in sysusers.d", username))
+}
+
+func (sysusersNSSSource) LookupUID(rootdir string, uid uint64) (username string, gid uint64, err error) {
+	entries, err := readSysusersEntries(rootdir)
+	if err != nil {
+		return "", 0, err
+	}
+	if entry, ok := entries.usersByUID[uid]; ok {
+		return entry.name, entry.gid, nil
+	}
+	return "", 0, user.UnknownUserError(fmt.Sprintf("error looking up user with UID %d in sysusers.d", uid))
+}
+
+func (sysusersNSSSource) LookupGroup(rootdir, groupname string) (gid uint64, err error) {
+	entries, err := readSysusersEntries(rootdir)
+	if err != nil {
+		return 0, err
+	}
+	if gid, ok := entries.groupsByName[groupname]; ok {
+		return gid, nil
+	}
+	return 0, user.UnknownGroupError(fmt.Sprintf("error looking up group %q in sysusers.d", groupname))
+}
+
+// LookupHome always fails: parseSysusersConfLine ignores the home
+// directory field of sysusers.d(5) lines, so there's nothing here for an
+// account that exists only as a sysusers.d declaration.  Callers
+// fall back to the default home ("/") in that case.
+func (sysusersNSSSource) LookupHome(rootdir, username string) (home string, err error) {
+	return "", user.UnknownUserError(fmt.Sprintf("error looking up user %q in sysusers.d", username))
+}
+
+var (
+	filesSource    NSSSource = filesNSSSource{}
+	altfilesSource NSSSource = altfilesNSSSource{}
+	sysusersSource NSSSource = sysusersNSSSource{}
+)
+
+// lookupGroupFilesOrAltfiles resolves groupname against rootdir's own
+// /etc/group and /usr/lib/group, without consulting sysusersSource. It's
+// what readSysusersEntries falls back to when a sysusers.d "u" line
+// names a group rather than a numeric GID, since going through the full
+// NSSSource chain (lookupGroupInContainer) would call back into
+// readSysusersEntries and recurse.
+func lookupGroupFilesOrAltfiles(rootdir, groupname string) (gid uint64, err error) {
+	for _, source := range []NSSSource{filesSource, altfilesSource} {
+		if gid, err = source.LookupGroup(rootdir, groupname); err == nil {
+			return gid, nil
+		}
+	}
+	return 0, user.UnknownGroupError(fmt.Sprintf("error looking up group %q", groupname))
+}
+
+// nsswitchOrder reads rootdir's /etc/nsswitch.conf, if it has one, and
+// returns the NSSSources listed for database ("passwd" or "group") in
+// the order given there.  Modules we don't implement (ldap, sss, and so
+// on) are skipped rather than erroring, so the sources we do support
+// still run.  It returns nil if there's no nsswitch.conf or no matching
+// line, letting the caller fall back to the default order.  The file is
+// read through openChrootedFile, like every other lookup in this file,
+// so a symlink at /etc/nsswitch.conf can't be used to read a host file.
+func nsswitchOrder(rootdir, database string) []NSSSource {
+	cmd, f, err := openChrootedFile(rootdir, "/etc/nsswitch.conf")
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	_ = cmd.Wait()
+	if err != nil {
+		return nil
+	}
+	prefix := database + ":"
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		var sources []NSSSource
+		for _, token := range strings.Fields(strings.TrimPrefix(line, prefix)) {
+			switch token {
+			case "files":
+				sources = append(sources, filesSource)
+			case "altfiles":
+				sources = append(sources, altfilesSource)
+			}
+		}
+		return sources
+	}
+	return nil
+}
+
+// nssSourcesForRootdir returns the ordered list of NSSSources to consult
+// for database ("passwd" or "group") in rootdir: rootdir's own
+// nsswitch.conf order if it has one honoring "files"/"altfiles" (default
+// to "files" alone otherwise), with the sysusers.d source always
+// consulted last to catch accounts the image declares but that haven't
+// been materialized yet.
+func nssSourcesForRootdir(rootdir, database string) []NSSSource {
+	sources := nsswitchOrder(rootdir, database)
+	if len(sources) == 0 {
+		sources = []NSSSource{filesSource}
+	}
+	return append(sources, sysusersSource)
+}
+
+// lookupUserInContainer resolves username against rootdir, consulting
+// its configured NSSSources in order and returning the first hit.
+func lookupUserInContainer(rootdir, username string) (uid uint64, gid uint64, err error) {
+	var lastErr error
+	for _, source := range nssSourcesForRootdir(rootdir, "passwd") {
+		if uid, gid, err = source.LookupUser(rootdir, username); err == nil {
+			return uid, gid, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = user.UnknownUserError(fmt.Sprintf("error looking up user %q", username))
+	}
+	return 0, 0, lastErr
+}
+
+// lookupGroupForUIDInContainer resolves userid against rootdir,
+// consulting its configured NSSSources in order and returning the first
+// hit.
+func lookupGroupForUIDInContainer(rootdir string, userid uint64) (username string, gid uint64, err error) {
+	var lastErr error
+	for _, source := range nssSourcesForRootdir(rootdir, "passwd") {
+		if username, gid, err = source.LookupUID(rootdir, userid); err == nil {
+			return username, gid, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = user.UnknownUserError(fmt.Sprintf("error looking up user with UID %d", userid))
+	}
+	return "", 0, lastErr
+}
+
+// lookupGroupInContainer resolves groupname against rootdir, consulting
+// its configured NSSSources in order and returning the first hit.
+func lookupGroupInContainer(rootdir, groupname string) (gid uint64, err error) {
+	var lastErr error
+	for _, source := range nssSourcesForRootdir(rootdir, "group") {
+		if gid, err = source.LookupGroup(rootdir, groupname); err == nil {
+			return gid, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = user.UnknownGroupError(fmt.Sprintf("error looking up group %q", groupname))
+	}
+	return 0, lastErr
+}
+
+// lookupHomeInContainer returns the home directory field recorded for
+// username in rootdir, consulting the same configured NSSSources, in
+// the same order, as lookupUserInContainer -- so a user resolved via
+// altfiles or sysusers.d has its home looked up the same way, instead of
+// only ever checking plain /etc/passwd.
+func lookupHomeInContainer(rootdir, username string) (home string, err error) {
+	var lastErr error
+	for _, source := range nssSourcesForRootdir(rootdir, "passwd") {
+		if home, err = source.LookupHome(rootdir, username); err == nil {
+			return home, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = user.UnknownUserError(fmt.Sprintf("error looking up user %q", username))
+	}
+	return "", lastErr
+}
+
+// GetUser parses userspec, the Dockerfile/OCI USER grammar, against
+// rootdir and returns the UID/GID that the container process should run
+// as, together with any additional GIDs from group membership and the
+// user's home directory.  userspec may be a bare name, a bare UID, or
+// either of those paired with a group name or GID after a colon
+// ("name:group", "uid:gid", "name:gid", "uid:group").  A numeric UID or
+// GID always succeeds, even if it has no entry in the container's
+// /etc/passwd or /etc/group, matching what the OCI runtime would accept.
+func GetUser(rootdir, userspec string) (uid, gid uint32, additionalGids []uint32, home string, err error) {
+	userArg, groupArg := userspec, ""
+	if parts := strings.SplitN(userspec, ":", 2); len(parts) == 2 {
+		userArg, groupArg = parts[0], parts[1]
+	}
+
+	home = "/"
+
+	var username string
+	uid64, gid64, lookErr := lookupUserInContainer(rootdir, userArg)
+	if lookErr == nil {
+		username = userArg
+	} else {
+		parsedUID, numErr := strconv.ParseUint(userArg, 10, 32)
+		if numErr != nil {
+			return 0, 0, nil, "", lookErr
+		}
+		uid64, gid64 = parsedUID, parsedUID
+		if name, pgid, uidErr := lookupGroupForUIDInContainer(rootdir, uid64); uidErr == nil {
+			username, gid64 = name, pgid
+		}
+	}
+
+	if username != "" {
+		if h, herr := lookupHomeInContainer(rootdir, username); herr == nil {
+			home = h
+		}
+	}
+
+	if groupArg != "" {
+		if resolvedGid, gerr := lookupGroupInContainer(rootdir, groupArg); gerr == nil {
+			gid64 = resolvedGid
+		} else if parsedGid, numErr := strconv.ParseUint(groupArg, 10, 32); numErr == nil {
+			gid64 = parsedGid
+		} else {
+			return 0, 0, nil, "", gerr
+		}
+	}
+
+	if gids, gerr := lookupAdditionalGroupsForUIDInContainer(rootdir, uid64); gerr == nil {
+		additionalGids = gids
+	}
+
+	return uint32(uid64), uint32(gid64), additionalGids, home, nil
+}
@@ -0,0 +1,305 @@
+// +build linux
+
+package buildah
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/containers/storage/pkg/reexec"
+)
+
+func TestMain(m *testing.M) {
+	if reexec.Init() {
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestParseNextPasswd(t *testing.T) {
+	rc := bufio.NewReader(strings.NewReader("root:x:0:0:root:/root:/bin/bash\nuser:x:1000:1000:A User:/home/user:/bin/sh\n"))
+
+	pwd := parseNextPasswd(rc)
+	if pwd == nil || pwd.name != "root" || pwd.uid != 0 || pwd.gid != 0 {
+		t.Fatalf("unexpected first entry: %+v", pwd)
+	}
+
+	pwd = parseNextPasswd(rc)
+	if pwd == nil || pwd.name != "user" || pwd.uid != 1000 || pwd.gid != 1000 {
+		t.Fatalf("unexpected second entry: %+v", pwd)
+	}
+
+	if pwd = parseNextPasswd(rc); pwd != nil {
+		t.Fatalf("expected nil at EOF, got %+v", pwd)
+	}
+}
+
+// TestParseNextPasswdMalformedLine documents that parseNextPasswd looks
+// at exactly one line per call: a malformed line returns nil immediately
+// rather than skipping ahead to the next valid record, so callers that
+// loop on parseNextPasswd (e.g. lookupUserInContainerOnce) stop there
+// even if more valid entries follow it in the file.
+func TestParseNextPasswdMalformedLine(t *testing.T) {
+	rc := bufio.NewReader(strings.NewReader("bad line\nuser:x:1000:1000:A User:/home/user:/bin/sh\n"))
+	if pwd := parseNextPasswd(rc); pwd != nil {
+		t.Fatalf("expected nil for a malformed line, got %+v", pwd)
+	}
+}
+
+func TestParseNextGroup(t *testing.T) {
+	rc := bufio.NewReader(strings.NewReader("wheel:x:10:root,user\nnogroup:x:65534:\n"))
+
+	grp := parseNextGroup(rc)
+	if grp == nil || grp.name != "wheel" || grp.gid != 10 || len(grp.users) != 2 || grp.users[0] != "root" || grp.users[1] != "user" {
+		t.Fatalf("unexpected first entry: %+v", grp)
+	}
+
+	grp = parseNextGroup(rc)
+	if grp == nil || grp.name != "nogroup" || grp.gid != 65534 || grp.users != nil {
+		t.Fatalf("unexpected second entry: %+v", grp)
+	}
+}
+
+// newTestRootdir builds a minimal rootfs under a temporary directory with
+// the given /etc/passwd and /etc/group contents, for tests that need to
+// chroot into something.
+func newTestRootdir(t *testing.T, passwd, group string) string {
+	t.Helper()
+	rootdir, err := ioutil.TempDir("", "buildah-user-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(rootdir) })
+
+	if err := os.MkdirAll(filepath.Join(rootdir, "etc"), 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootdir, "etc", "passwd"), []byte(passwd), 0o644); err != nil {
+		t.Fatalf("WriteFile(passwd): %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(rootdir, "etc", "group"), []byte(group), 0o644); err != nil {
+		t.Fatalf("WriteFile(group): %v", err)
+	}
+	return rootdir
+}
+
+// requireRoot skips the calling test unless it's running as root: every
+// lookup in this file chroots, which requires CAP_SYS_CHROOT.
+func requireRoot(t *testing.T) {
+	t.Helper()
+	if os.Getuid() != 0 {
+		t.Skip("need root to chroot")
+	}
+}
+
+func TestGenerateSyntheticUserOverlay(t *testing.T) {
+	requireRoot(t)
+
+	rootdir := newTestRootdir(t, "root:x:0:0:root:/root:/bin/bash\n", "root:x:0:\n")
+	t.Cleanup(func() { _ = CloseChrootUserResolver(rootdir) })
+
+	passwdFile, groupFile, err := GenerateSyntheticUserOverlay(rootdir, 4242, 4242)
+	if err != nil {
+		t.Fatalf("GenerateSyntheticUserOverlay: %v", err)
+	}
+	defer os.Remove(passwdFile)
+	defer os.Remove(groupFile)
+
+	for _, path := range []string{passwdFile, groupFile} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Stat(%q): %v", path, err)
+		}
+		if info.Mode().Perm() != syntheticOverlayMode {
+			t.Errorf("%s has mode %o, want %o", path, info.Mode().Perm(), syntheticOverlayMode)
+		}
+	}
+
+	// A UID that already has an entry needs no overlay.
+	passwdFile, groupFile, err = GenerateSyntheticUserOverlay(rootdir, 0, 0)
+	if err != nil {
+		t.Fatalf("GenerateSyntheticUserOverlay(existing uid): %v", err)
+	}
+	if passwdFile != "" || groupFile != "" {
+		t.Errorf("GenerateSyntheticUserOverlay(existing uid) = (%q, %q), want empty", passwdFile, groupFile)
+	}
+}
+
+// TestChrootUserResolverCaching exercises the scenario a plain persistent
+// cache would get wrong: a lookup that warms the resolver, a change to
+// /etc/passwd underneath it (e.g. a RUN useradd), and a second lookup
+// that must see the change rather than the stale snapshot.
+func TestChrootUserResolverCaching(t *testing.T) {
+	requireRoot(t)
+
+	rootdir := newTestRootdir(t, "root:x:0:0:root:/root:/bin/bash\n", "root:x:0:\n")
+	t.Cleanup(func() { _ = CloseChrootUserResolver(rootdir) })
+
+	if _, _, err := lookupUserInContainer(rootdir, "newuser"); err == nil {
+		t.Fatalf("expected newuser to be unknown before it's added")
+	}
+
+	// Give the filesystem's mtime clock a chance to advance before the
+	// rewrite below, so the resolver can actually detect the change.
+	time.Sleep(1100 * time.Millisecond)
+
+	passwdPath := filepath.Join(rootdir, "etc", "passwd")
+	data, err := ioutil.ReadFile(passwdPath)
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	data = append(data, []byte("newuser:x:1001:1001:New User:/home/newuser:/bin/sh\n")...)
+	if err := ioutil.WriteFile(passwdPath, data, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	uid, gid, err := lookupUserInContainer(rootdir, "newuser")
+	if err != nil {
+		t.Fatalf("lookupUserInContainer(newuser) after update: %v", err)
+	}
+	if uid != 1001 || gid != 1001 {
+		t.Fatalf("lookupUserInContainer(newuser) = (%d, %d), want (1001, 1001)", uid, gid)
+	}
+}
+
+func TestParseSysusersConfLine(t *testing.T) {
+	tests := []struct {
+		line        string
+		wantKind    byte
+		wantName    string
+		wantIDField string
+		wantOK      bool
+	}{
+		{"u syslog 104:adm \"syslog account\"", 'u', "syslog", "104:adm", true},
+		{"u nginx 104 -", 'u', "nginx", "104", true},
+		{"g wheel 10", 'g', "wheel", "10", true},
+		{"m nginx wheel", 'm', "nginx", "", true},
+		{"# a comment", 0, "", "", false},
+		{"", 0, "", "", false},
+		{"u", 0, "", "", false},
+	}
+	for _, tt := range tests {
+		kind, name, idField, ok := parseSysusersConfLine(tt.line)
+		if ok != tt.wantOK {
+			t.Errorf("parseSysusersConfLine(%q): ok = %v, want %v", tt.line, ok, tt.wantOK)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if kind != tt.wantKind || name != tt.wantName || idField != tt.wantIDField {
+			t.Errorf("parseSysusersConfLine(%q) = (%c, %q, %q), want (%c, %q, %q)",
+				tt.line, kind, name, idField, tt.wantKind, tt.wantName, tt.wantIDField)
+		}
+	}
+}
+
+func TestReadSysusersEntries(t *testing.T) {
+	requireRoot(t)
+
+	rootdir := newTestRootdir(t, "root:x:0:0:root:/root:/bin/bash\n", "root:x:0:\n")
+	sysusersDir := filepath.Join(rootdir, "usr", "lib", "sysusers.d")
+	if err := os.MkdirAll(sysusersDir, 0o755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	conf := "g adm 4\nu syslog 104:adm\nu nginx 105:105\n"
+	if err := ioutil.WriteFile(filepath.Join(sysusersDir, "base.conf"), []byte(conf), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	entries, err := readSysusersEntries(rootdir)
+	if err != nil {
+		t.Fatalf("readSysusersEntries: %v", err)
+	}
+
+	syslog, ok := entries.usersByName["syslog"]
+	if !ok {
+		t.Fatalf("expected a syslog entry, got %+v", entries.usersByName)
+	}
+	if syslog.uid != 104 || syslog.gid != 4 {
+		t.Errorf("syslog entry = %+v, want uid=104 gid=4 (resolved from the named group \"adm\")", syslog)
+	}
+
+	nginx, ok := entries.usersByName["nginx"]
+	if !ok || nginx.uid != 105 || nginx.gid != 105 {
+		t.Errorf("nginx entry = %+v, want uid=105 gid=105", nginx)
+	}
+}
+
+func TestNsswitchOrder(t *testing.T) {
+	requireRoot(t)
+
+	rootdir := newTestRootdir(t, "root:x:0:0:root:/root:/bin/bash\n", "root:x:0:\n")
+	if err := ioutil.WriteFile(filepath.Join(rootdir, "etc", "nsswitch.conf"), []byte("passwd: altfiles files\ngroup: files\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	sources := nsswitchOrder(rootdir, "passwd")
+	if len(sources) != 2 {
+		t.Fatalf("nsswitchOrder(passwd) returned %d sources, want 2", len(sources))
+	}
+	if _, ok := sources[0].(altfilesNSSSource); !ok {
+		t.Errorf("nsswitchOrder(passwd)[0] = %T, want altfilesNSSSource", sources[0])
+	}
+	if _, ok := sources[1].(filesNSSSource); !ok {
+		t.Errorf("nsswitchOrder(passwd)[1] = %T, want filesNSSSource", sources[1])
+	}
+
+	if sources := nsswitchOrder(rootdir, "shadow"); sources != nil {
+		t.Errorf("nsswitchOrder(shadow) = %v, want nil (no matching line)", sources)
+	}
+}
+
+func TestGetUserGrammar(t *testing.T) {
+	requireRoot(t)
+
+	rootdir := newTestRootdir(t,
+		"root:x:0:0:root:/root:/bin/bash\nsyslog:x:104:102:syslog:/home/syslog:/usr/sbin/nologin\n",
+		"root:x:0:\nadm:x:102:syslog\n",
+	)
+	t.Cleanup(func() { _ = CloseChrootUserResolver(rootdir) })
+
+	tests := []struct {
+		name     string
+		userspec string
+		wantUID  uint32
+		wantGID  uint32
+		wantHome string
+		wantErr  bool
+	}{
+		{"bare name", "root", 0, 0, "/root", false},
+		{"bare uid", "0", 0, 0, "/root", false},
+		{"name:group", "root:adm", 0, 102, "/root", false},
+		{"uid:gid", "0:102", 0, 102, "/root", false},
+		{"name:gid", "root:102", 0, 102, "/root", false},
+		{"uid:group", "0:adm", 0, 102, "/root", false},
+		{"unknown numeric uid", "4242", 4242, 4242, "/", false},
+		{"named user, empty group falls back to primary gid", "syslog", 104, 102, "/home/syslog", false},
+		{"unknown uid with named group", "4242:adm", 4242, 102, "/", false},
+		{"unknown name", "nosuchuser", 0, 0, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, gid, _, home, err := GetUser(rootdir, tt.userspec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("GetUser(%q): expected error, got none", tt.userspec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetUser(%q): unexpected error: %v", tt.userspec, err)
+			}
+			if uid != tt.wantUID || gid != tt.wantGID || home != tt.wantHome {
+				t.Fatalf("GetUser(%q) = (%d, %d, home=%q), want (%d, %d, home=%q)",
+					tt.userspec, uid, gid, home, tt.wantUID, tt.wantGID, tt.wantHome)
+			}
+		})
+	}
+}